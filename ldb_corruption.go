@@ -0,0 +1,136 @@
+package ctlstore
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync/atomic"
+
+	"github.com/segmentio/ctlstore/pkg/globalstats"
+	"github.com/segmentio/errors-go"
+	"github.com/segmentio/stats"
+)
+
+// ErrLDBCorrupted is returned from reader methods when the underlying
+// SQLite file is found to be corrupted. The reader marks itself unhealthy
+// and attempts recovery within the call that discovered it, before this
+// error is returned; callers should treat this the same as a temporary
+// unavailability and retry later, checking Health() to see whether that
+// recovery succeeded.
+var ErrLDBCorrupted = errors.New("ldb: database is corrupted")
+
+// corruptionMarkers are substrings of SQLite error text (and, on some
+// drivers, error codes) that indicate on-disk corruption rather than a
+// transient or query-shaped error. Modeled on goleveldb's errors.IsCorrupted.
+var corruptionMarkers = []string{
+	"database disk image is malformed",
+	"file is not a database",
+	"sqlite_corrupt",
+	"sqlite_notadb",
+}
+
+// isCorruptionErr reports whether err looks like SQLite corruption rather
+// than an ordinary query error.
+func isCorruptionErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, marker := range corruptionMarkers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecoveryFunc rebuilds a reader's *sql.DB handle after corruption is
+// detected. It's invoked with the current cached prepared statements and
+// DB handle already closed.
+type RecoveryFunc func(ctx context.Context) (*sql.DB, error)
+
+// LDBReaderOption configures optional behavior on an LDBReader at
+// construction time.
+type LDBReaderOption func(*LDBReader)
+
+// WithRecoveryFunc overrides the function the reader calls to rebuild its
+// database handle after corruption is detected. Without one, corruption
+// still marks the reader unhealthy, but recovery itself fails with an
+// error since the reader has no DSN of its own to reopen.
+func WithRecoveryFunc(fn RecoveryFunc) LDBReaderOption {
+	return func(r *LDBReader) { r.recoveryFunc = fn }
+}
+
+// WithOnCorruption registers a callback invoked every time corruption is
+// detected, after recovery has been attempted. This is the hook a
+// supervisor process should use to force a reflector re-snapshot.
+func WithOnCorruption(fn func(err error)) LDBReaderOption {
+	return func(r *LDBReader) { r.onCorruption = fn }
+}
+
+func defaultRecoveryFunc(ctx context.Context) (*sql.DB, error) {
+	return nil, errors.New("ldb: no RecoveryFunc configured, cannot reopen after corruption")
+}
+
+// Health reports whether the reader believes its underlying DB is usable.
+// It's driven by corruption detection in GetRowByKey, GetRowsByKeyPrefix,
+// Exists, ExistsMulti, and Ping, not by an active background check.
+func (reader *LDBReader) Health() bool {
+	return atomic.LoadInt32(&reader.healthy) == 1
+}
+
+// handleCorruption responds to a detected corruption error by draining and
+// closing the reader's cached prepared statements and DB handle, then
+// invoking the configured RecoveryFunc to rebuild the handle.
+//
+// WARNING: assumes mutex is read locked; it's upgraded to a write lock for
+// the duration of the rebuild and downgraded again before returning.
+func (reader *LDBReader) handleCorruption(ctx context.Context, cause error) {
+	reader.mu.RUnlock()
+	reader.mu.Lock()
+	defer func() {
+		reader.mu.Unlock()
+		reader.mu.RLock()
+	}()
+
+	atomic.StoreInt32(&reader.healthy, 0)
+
+	for _, stmt := range reader.getRowByKeyStmtCache {
+		stmt.Close()
+	}
+	reader.getRowByKeyStmtCache = nil
+	for _, stmt := range reader.getRowsByKeyPrefixStmtCache {
+		stmt.Close()
+	}
+	reader.getRowsByKeyPrefixStmtCache = nil
+	for _, stmt := range reader.getRowsByRangeStmtCache {
+		stmt.Close()
+	}
+	reader.getRowsByRangeStmtCache = nil
+	for _, stmt := range reader.existsStmtCache {
+		stmt.Close()
+	}
+	reader.existsStmtCache = nil
+	reader.pkCache = nil
+	reader.colMetaCache = nil
+
+	if reader.Db != nil {
+		reader.Db.Close()
+	}
+
+	globalstats.Incr("ldb_corruption_recovery", stats.T("stage", "detected"))
+
+	newDB, err := reader.recoveryFunc(ctx)
+	if err != nil {
+		globalstats.Incr("ldb_corruption_recovery", stats.T("stage", "failed"))
+	} else {
+		reader.Db = newDB
+		reader.queryHandle.db = newDB
+		atomic.StoreInt32(&reader.healthy, 1)
+		globalstats.Incr("ldb_corruption_recovery", stats.T("stage", "recovered"))
+	}
+
+	if reader.onCorruption != nil {
+		reader.onCorruption(cause)
+	}
+}
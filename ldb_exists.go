@@ -0,0 +1,255 @@
+package ctlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ctlstore/pkg/globalstats"
+	"github.com/segmentio/ctlstore/pkg/schema"
+	"github.com/segmentio/errors-go"
+	"github.com/segmentio/stats"
+)
+
+// sqliteMaxBoundVariables is SQLite's default SQLITE_LIMIT_VARIABLE_NUMBER.
+// ExistsMulti chunks its batches to this limit so a large key set doesn't
+// overflow a single statement's bound parameters.
+const sqliteMaxBoundVariables = 999
+
+// buildPKEqualsClause returns a "col1 = ? AND col2 = ? ..." clause matching
+// every field of pk in order.
+func buildPKEqualsClause(pk schema.PrimaryKey) string {
+	parts := make([]string, len(pk.Fields))
+	for i, pkField := range pk.Fields {
+		parts[i] = pkField.Name + " = ?"
+	}
+	return strings.Join(parts, " AND ")
+}
+
+func (reader *LDBReader) getExistsStmt(ctx context.Context, pk schema.PrimaryKey, ldbTable string) (*sql.Stmt, error) {
+	// assumes RLock is held
+	if reader.existsStmtCache == nil {
+		reader.mu.RUnlock()
+		reader.mu.Lock()
+		if reader.existsStmtCache == nil {
+			reader.existsStmtCache = make(map[string]*sql.Stmt)
+		}
+		reader.mu.Unlock()
+		reader.mu.RLock()
+	}
+
+	if stmt, found := reader.existsStmtCache[ldbTable]; found {
+		return stmt, nil
+	}
+
+	reader.mu.RUnlock()
+	defer reader.mu.RLock()
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+
+	qs := "SELECT 1 FROM " + ldbTable + " WHERE " + buildPKEqualsClause(pk) + " LIMIT 1"
+	stmt, err := reader.Db.PrepareContext(ctx, qs)
+	if err == nil {
+		reader.existsStmtCache[ldbTable] = stmt
+	}
+	return stmt, err
+}
+
+// Exists reports whether a row with the supplied full primary key exists in
+// the given family/table, without materializing the row. It's cheaper than
+// GetRowByKey for a plain existence check since there's no column-meta
+// reflection or scanfunc construction on the hit path, and the compiled
+// statement returns a single constant column so SQLite can short-circuit
+// off the PK index.
+func (reader *LDBReader) Exists(ctx context.Context, familyName string, tableName string, key ...interface{}) (bool, error) {
+	start := time.Now()
+	defer func() {
+		globalstats.Observe("exists", time.Now().Sub(start),
+			stats.T("family", familyName),
+			stats.T("table", tableName))
+	}()
+
+	reader.mu.RLock()
+	defer reader.mu.RUnlock()
+
+	famName, err := schema.NewFamilyName(familyName)
+	if err != nil {
+		return false, err
+	}
+	tblName, err := schema.NewTableName(tableName)
+	if err != nil {
+		return false, err
+	}
+	ldbTable := schema.LDBTableName(famName, tblName)
+
+	pk, err := reader.getPrimaryKey(ctx, ldbTable)
+	if err != nil {
+		return false, err
+	}
+	if pk.Zero() {
+		return false, ErrTableHasNoPrimaryKey
+	}
+	if len(pk.Fields) != len(key) {
+		return false, ErrNeedFullKey
+	}
+
+	stmt, err := reader.getExistsStmt(ctx, pk, ldbTable)
+	if err != nil {
+		return false, err
+	}
+	if err := convertKeyBeforeQuery(pk, key); err != nil {
+		return false, err
+	}
+
+	var found int
+	err = stmt.QueryRowContext(ctx, key...).Scan(&found)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err == nil:
+		return found == 1, nil
+	case isCorruptionErr(err):
+		reader.handleCorruption(ctx, err)
+		return false, ErrLDBCorrupted
+	default:
+		// See the NOTE in queryHandle.getRowByKey about why this cache is getting cleared
+		reader.invalidatePKCache(ldbTable)
+		return false, errors.Wrap(err, "exists query error")
+	}
+}
+
+// ExistsMulti is the batched form of Exists: it checks existence for every
+// key in keys using WHERE (pk1, pk2, ...) IN (VALUES (?, ?), ...) queries,
+// one per batch of keys that fits SQLite's bound-parameter limit (a single
+// round trip when all keys fit in one batch), and returns a bool per input
+// key in the same order as supplied.
+func (reader *LDBReader) ExistsMulti(ctx context.Context, familyName string, tableName string, keys [][]interface{}) ([]bool, error) {
+	start := time.Now()
+	defer func() {
+		globalstats.Observe("exists_multi", time.Now().Sub(start),
+			stats.T("family", familyName),
+			stats.T("table", tableName))
+	}()
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	reader.mu.RLock()
+	defer reader.mu.RUnlock()
+
+	famName, err := schema.NewFamilyName(familyName)
+	if err != nil {
+		return nil, err
+	}
+	tblName, err := schema.NewTableName(tableName)
+	if err != nil {
+		return nil, err
+	}
+	ldbTable := schema.LDBTableName(famName, tblName)
+
+	pk, err := reader.getPrimaryKey(ctx, ldbTable)
+	if err != nil {
+		return nil, err
+	}
+	if pk.Zero() {
+		return nil, ErrTableHasNoPrimaryKey
+	}
+
+	for _, key := range keys {
+		if len(pk.Fields) != len(key) {
+			return nil, ErrNeedFullKey
+		}
+		if err := convertKeyBeforeQuery(pk, key); err != nil {
+			return nil, err
+		}
+	}
+
+	pkCols := make([]string, len(pk.Fields))
+	for i, f := range pk.Fields {
+		pkCols[i] = f.Name
+	}
+
+	// SQLite caps the number of bound parameters per statement (999 by
+	// default), so a large batch has to be split across several queries
+	// rather than sent as one giant VALUES list.
+	batchSize := sqliteMaxBoundVariables / len(pkCols)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	seen := make(map[string]struct{}, len(keys))
+	for i := 0; i < len(keys); i += batchSize {
+		end := i + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := reader.existsMultiBatch(ctx, ldbTable, pkCols, keys[i:end], seen); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]bool, len(keys))
+	for i, key := range keys {
+		_, results[i] = seen[existsMultiRowKey(key)]
+	}
+	return results, nil
+}
+
+// existsMultiBatch runs a single WHERE (pk1, pk2, ...) IN (VALUES ...)
+// query for one batch of keys, adding every key that exists to seen.
+//
+// WARNING: assumes RLock is held.
+func (reader *LDBReader) existsMultiBatch(ctx context.Context, ldbTable string, pkCols []string, keys [][]interface{}, seen map[string]struct{}) error {
+	valuesTuple := "(" + strings.Repeat("?, ", len(pkCols)-1) + "?)"
+	valuesTuples := make([]string, len(keys))
+	args := make([]interface{}, 0, len(keys)*len(pkCols))
+	for i, key := range keys {
+		valuesTuples[i] = valuesTuple
+		args = append(args, key...)
+	}
+
+	qs := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE (%s) IN (VALUES %s)",
+		strings.Join(pkCols, ", "),
+		ldbTable,
+		strings.Join(pkCols, ", "),
+		strings.Join(valuesTuples, ", "),
+	)
+
+	rows, err := reader.Db.QueryContext(ctx, qs, args...)
+	if err != nil {
+		if isCorruptionErr(err) {
+			reader.handleCorruption(ctx, err)
+			return ErrLDBCorrupted
+		}
+		reader.invalidatePKCache(ldbTable)
+		return errors.Wrap(err, "exists multi query error")
+	}
+	defer rows.Close()
+
+	rawVals := make([]interface{}, len(pkCols))
+	scanDest := make([]interface{}, len(pkCols))
+	for i := range rawVals {
+		scanDest[i] = &rawVals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(scanDest...); err != nil {
+			return errors.Wrap(err, "exists multi scan error")
+		}
+		seen[existsMultiRowKey(rawVals)] = struct{}{}
+	}
+	return errors.Wrap(rows.Err(), "exists multi rows error")
+}
+
+// existsMultiRowKey builds a comparable map key out of a PK tuple so
+// ExistsMulti can match returned rows back to the keys that were asked for.
+func existsMultiRowKey(vals []interface{}) string {
+	parts := make([]string, len(vals))
+	for i, v := range vals {
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, "\x00")
+}
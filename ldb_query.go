@@ -0,0 +1,292 @@
+package ctlstore
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ctlstore/pkg/globalstats"
+	"github.com/segmentio/errors-go"
+	"github.com/segmentio/stats"
+)
+
+var (
+	// ErrUnsupportedQuery is returned when a query passed to QueryRows
+	// falls outside the supported SELECT subset, e.g. it contains a join,
+	// a write, a pragma, or a subquery.
+	ErrUnsupportedQuery = errors.New("query is not a supported read-only SELECT")
+	// ErrUnknownColumn is returned when QueryRows references a column that
+	// does not exist on the target LDB table.
+	ErrUnknownColumn = errors.New("unknown column")
+)
+
+// queryPattern matches the safe subset of SQL accepted by QueryRows:
+//
+//	SELECT <cols> FROM <table> [WHERE ...] [ORDER BY ...] [LIMIT N]
+var queryPattern = regexp.MustCompile(`(?is)^\s*SELECT\s+(?P<cols>.+?)\s+FROM\s+(?P<table>[A-Za-z0-9_]+)(?:\s+WHERE\s+(?P<where>.+?))?(?:\s+ORDER\s+BY\s+(?P<orderby>.+?))?(?:\s+LIMIT\s+(?P<limit>\d+))?\s*;?\s*$`)
+
+// disallowedQueryWords reject everything QueryRows isn't meant to support:
+// joins, writes, pragmas, and anything DDL-shaped. Matched word-bounded so
+// ordinary column names like updated_at, created_at, attachment_id, or
+// dropoff_time don't trip the filter just for containing a keyword as a
+// substring.
+var disallowedQueryWords = []string{
+	"JOIN", "UNION", "INSERT", "UPDATE", "DELETE", "PRAGMA",
+	"ATTACH", "DETACH", "DROP", "ALTER", "CREATE", "REPLACE",
+}
+
+var disallowedQueryWordPattern = regexp.MustCompile(`(?i)\b(` + strings.Join(disallowedQueryWords, "|") + `)\b`)
+
+// disallowedQuerySubstrings aren't word-shaped, so they're checked as plain
+// substrings rather than folded into disallowedQueryWordPattern.
+var disallowedQuerySubstrings = []string{"--", "/*"}
+
+type parsedQuery struct {
+	columns  []string
+	table    string
+	where    string
+	orderBy  string
+	limit    int
+	hasLimit bool
+}
+
+// parseQuery validates that query is a member of the safe SELECT subset
+// QueryRows supports and breaks it into its clauses. It does not touch the
+// database, so it can't tell whether the table or columns actually exist.
+func parseQuery(query string) (parsedQuery, error) {
+	// Scan a quote-masked copy for keywords/parens so a quoted string
+	// literal's contents (a comma, a stray paren, a keyword-shaped word)
+	// can't be mistaken for query structure. The unmasked query is used
+	// everywhere the actual clause text matters.
+	masked := maskQuotedLiterals(query)
+
+	if kw := disallowedQueryWordPattern.FindString(masked); kw != "" {
+		return parsedQuery{}, errors.Wrap(ErrUnsupportedQuery, "disallowed keyword "+strings.ToUpper(kw))
+	}
+	for _, sub := range disallowedQuerySubstrings {
+		if strings.Contains(masked, sub) {
+			return parsedQuery{}, errors.Wrap(ErrUnsupportedQuery, "disallowed token "+sub)
+		}
+	}
+	// Parens are only allowed to hold an "IN (?, ?, ...)"-style list of
+	// placeholders and literals, which is the standard way to pass a set of
+	// args into a parameterized query. Anything else in parens (a
+	// subquery, a function call) is rejected.
+	if err := validateQueryParens(masked); err != nil {
+		return parsedQuery{}, err
+	}
+	if err := validateQuerySemicolons(masked); err != nil {
+		return parsedQuery{}, err
+	}
+
+	m := queryPattern.FindStringSubmatch(query)
+	if m == nil {
+		return parsedQuery{}, errors.Wrap(ErrUnsupportedQuery, "query does not match the supported SELECT subset")
+	}
+	groups := make(map[string]string, len(m))
+	for i, name := range queryPattern.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+		groups[name] = strings.TrimSpace(m[i])
+	}
+
+	var pq parsedQuery
+	for _, col := range strings.Split(groups["cols"], ",") {
+		col = strings.TrimSpace(col)
+		if col != "" {
+			pq.columns = append(pq.columns, col)
+		}
+	}
+	if len(pq.columns) == 0 {
+		return parsedQuery{}, errors.Wrap(ErrUnsupportedQuery, "no columns selected")
+	}
+	pq.table = groups["table"]
+	pq.where = groups["where"]
+	pq.orderBy = groups["orderby"]
+	if limit := groups["limit"]; limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return parsedQuery{}, errors.Wrap(ErrUnsupportedQuery, "invalid LIMIT")
+		}
+		pq.limit = n
+		pq.hasLimit = true
+	}
+	return pq, nil
+}
+
+// maskQuotedLiterals returns a copy of query with the interior of every
+// single-quoted string literal replaced by 'x', preserving length and the
+// position of every other character (including the quotes themselves). A
+// doubled '' inside a literal is SQL's escaped quote and stays masked as
+// part of the literal rather than closing it. This lets the keyword/paren
+// scans below treat literal contents as opaque instead of mistaking a
+// comma, a paren, or a keyword-shaped substring inside a literal for query
+// structure.
+func maskQuotedLiterals(query string) string {
+	runes := []rune(query)
+	var b strings.Builder
+	b.Grow(len(runes))
+	inLiteral := false
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\'' && !inLiteral:
+			inLiteral = true
+			b.WriteRune(r)
+		case r == '\'' && inLiteral:
+			if i+1 < len(runes) && runes[i+1] == '\'' {
+				b.WriteRune('x')
+				b.WriteRune('x')
+				i++
+				continue
+			}
+			inLiteral = false
+			b.WriteRune(r)
+		case inLiteral:
+			b.WriteRune('x')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// validateQueryParens checks that every parenthesized group in query is a
+// flat, comma-separated list of placeholders ("?") or literals, e.g. an
+// "IN (?, ?, ?)" clause. Nested parens and anything else inside a group
+// (a subquery, a function call) are rejected. query is expected to already
+// be quote-masked (see maskQuotedLiterals) so parens/commas inside a string
+// literal aren't mistaken for structure.
+func validateQueryParens(query string) error {
+	depth := 0
+	var group strings.Builder
+	for _, r := range query {
+		switch r {
+		case '(':
+			depth++
+			if depth > 1 {
+				return errors.Wrap(ErrUnsupportedQuery, "nested parentheses are not supported")
+			}
+			group.Reset()
+		case ')':
+			depth--
+			if depth < 0 {
+				return errors.Wrap(ErrUnsupportedQuery, "unbalanced parentheses")
+			}
+			if depth == 0 {
+				if err := validateQueryParenGroup(group.String()); err != nil {
+					return err
+				}
+			}
+		default:
+			if depth > 0 {
+				group.WriteRune(r)
+			}
+		}
+	}
+	if depth != 0 {
+		return errors.Wrap(ErrUnsupportedQuery, "unbalanced parentheses")
+	}
+	return nil
+}
+
+// validateQuerySemicolons rejects any query containing a ";" other than a
+// single one trailing the whole statement. Without this, the DOTALL, lazy
+// where/orderby groups in queryPattern will happily absorb a second
+// statement stacked after a ";" (e.g. "...WHERE id = 1; SELECT secret FROM
+// other_table"), which sqlite3's Query driver then executes as multiple
+// statements, returning results from the last one - defeating the whole
+// point of validating query against a single target table. query is
+// expected to already be quote-masked (see maskQuotedLiterals) so a ";"
+// inside a string literal isn't mistaken for a statement separator.
+func validateQuerySemicolons(query string) error {
+	trimmed := strings.TrimRight(query, " \t\r\n")
+	idx := strings.IndexByte(trimmed, ';')
+	if idx == -1 {
+		return nil
+	}
+	if idx != len(trimmed)-1 {
+		return errors.Wrap(ErrUnsupportedQuery, "stacked statements are not supported")
+	}
+	return nil
+}
+
+func validateQueryParenGroup(inner string) error {
+	if strings.Contains(strings.ToUpper(inner), "SELECT") {
+		return errors.Wrap(ErrUnsupportedQuery, "subqueries are not supported")
+	}
+	for _, item := range strings.Split(inner, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+			return errors.Wrap(ErrUnsupportedQuery, "empty item in parenthesized list")
+		case item == "?":
+		case isQueryLiteral(item):
+		default:
+			return errors.Wrap(ErrUnsupportedQuery, "unsupported expression in parentheses: "+item)
+		}
+	}
+	return nil
+}
+
+// isQueryLiteral reports whether s is a quoted string or numeric literal,
+// the only non-placeholder values allowed inside a parenthesized list.
+func isQueryLiteral(s string) bool {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return true
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// validateIdentifiers checks that every identifier in idents (column names,
+// optionally followed by "ASC"/"DESC" in the ORDER BY case) is present in
+// allowed, a lowercased column-name set.
+func validateIdentifiers(idents []string, allowed map[string]struct{}) error {
+	for _, ident := range idents {
+		if ident == "*" {
+			continue
+		}
+		name := ident
+		if idx := strings.IndexByte(name, ' '); idx >= 0 {
+			name = name[:idx]
+		}
+		if _, ok := allowed[strings.ToLower(name)]; !ok {
+			return errors.Wrap(ErrUnknownColumn, name)
+		}
+	}
+	return nil
+}
+
+// QueryRows executes a constrained, read-only SQL query against a single
+// LDB table and streams the results back through a *Rows iterator. Only a
+// safe subset of SQL is accepted:
+//
+//	SELECT <cols> FROM <family>___<table> [WHERE ...] [ORDER BY ...] [LIMIT N]
+//
+// familyName and tableName must name the same table referenced in the
+// query's FROM clause; joins, writes, pragmas, and subqueries are rejected.
+// This lets callers filter and project rows in SQLite instead of pulling
+// whole tables into Go to do it themselves.
+func (reader *LDBReader) QueryRows(ctx context.Context, familyName string, tableName string, query string, args ...interface{}) (*Rows, error) {
+	start := time.Now()
+	defer func() {
+		globalstats.Observe("query_rows", time.Now().Sub(start),
+			stats.T("family", familyName),
+			stats.T("table", tableName),
+			stats.T("query_kind", "select"))
+	}()
+
+	reader.mu.RLock()
+	defer reader.mu.RUnlock()
+
+	ldbTable, err := resolveLDBTable(familyName, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader.queryRows(ctx, ldbTable, query, args)
+}
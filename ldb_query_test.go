@@ -0,0 +1,147 @@
+package ctlstore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr string // substring expected in the error, empty if no error expected
+		table   string
+		cols    []string
+		where   string
+		orderBy string
+		limit   int
+	}{
+		{
+			name:    "basic select with order by and limit",
+			query:   "SELECT id, updated_at FROM fam___tbl ORDER BY updated_at LIMIT 100",
+			table:   "fam___tbl",
+			cols:    []string{"id", "updated_at"},
+			orderBy: "updated_at",
+			limit:   100,
+		},
+		{
+			name:  "where clause",
+			query: "SELECT * FROM fam___tbl WHERE id = ?",
+			table: "fam___tbl",
+			cols:  []string{"*"},
+			where: "id = ?",
+		},
+		{
+			name:  "in list of placeholders",
+			query: "SELECT * FROM fam___tbl WHERE id IN (?, ?, ?)",
+			table: "fam___tbl",
+			cols:  []string{"*"},
+			where: "id IN (?, ?, ?)",
+		},
+		{
+			name:  "in list of literals",
+			query: "SELECT * FROM fam___tbl WHERE status IN ('a', 'b', 1)",
+			table: "fam___tbl",
+			cols:  []string{"*"},
+			where: "status IN ('a', 'b', 1)",
+		},
+		{
+			// Regression: a naive substring match on disallowed keywords
+			// used to reject ordinary column names containing them.
+			name:  "columns that merely contain disallowed keywords as substrings",
+			query: "SELECT updated_at, created_at, deleted_at, attachment_id, alternate_id, dropoff_time, replacement_id FROM fam___tbl",
+			table: "fam___tbl",
+			cols: []string{
+				"updated_at", "created_at", "deleted_at", "attachment_id",
+				"alternate_id", "dropoff_time", "replacement_id",
+			},
+		},
+		{
+			name:    "disallowed keyword as its own word",
+			query:   "SELECT * FROM a JOIN b",
+			wantErr: "disallowed keyword JOIN",
+		},
+		{
+			name:    "subquery in parens is rejected",
+			query:   "SELECT * FROM fam___tbl WHERE id IN (SELECT id FROM other)",
+			wantErr: "subqueries are not supported",
+		},
+		{
+			name:    "nested parens are rejected",
+			query:   "SELECT * FROM fam___tbl WHERE id IN ((?))",
+			wantErr: "nested parentheses are not supported",
+		},
+		{
+			name:    "unbalanced parens",
+			query:   "SELECT * FROM fam___tbl WHERE id IN (?",
+			wantErr: "unbalanced parentheses",
+		},
+		{
+			name:    "stacked statement after semicolon is rejected",
+			query:   "SELECT * FROM fam___tbl WHERE id = 1; SELECT secret FROM other_family___sensitive",
+			wantErr: "stacked statements are not supported",
+		},
+		{
+			name:  "single trailing semicolon is allowed",
+			query: "SELECT * FROM fam___tbl WHERE id = ?;",
+			table: "fam___tbl",
+			cols:  []string{"*"},
+			where: "id = ?",
+		},
+		{
+			name:    "sql comment is rejected",
+			query:   "SELECT * FROM fam___tbl -- trailing comment",
+			wantErr: "disallowed token",
+		},
+		{
+			name:    "does not match the supported subset",
+			query:   "EXPLAIN SELECT * FROM fam___tbl",
+			wantErr: "does not match the supported SELECT subset",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pq, err := parseQuery(tt.query)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatalf("parseQuery(%q) = nil error, want error containing %q", tt.query, tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseQuery(%q) error = %q, want it to contain %q", tt.query, err.Error(), tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseQuery(%q) unexpected error: %v", tt.query, err)
+			}
+			if pq.table != tt.table {
+				t.Errorf("table = %q, want %q", pq.table, tt.table)
+			}
+			if !equalStrings(pq.columns, tt.cols) {
+				t.Errorf("columns = %v, want %v", pq.columns, tt.cols)
+			}
+			if pq.where != tt.where {
+				t.Errorf("where = %q, want %q", pq.where, tt.where)
+			}
+			if pq.orderBy != tt.orderBy {
+				t.Errorf("orderBy = %q, want %q", pq.orderBy, tt.orderBy)
+			}
+			if tt.limit != 0 && (!pq.hasLimit || pq.limit != tt.limit) {
+				t.Errorf("limit = %d (hasLimit=%v), want %d", pq.limit, pq.hasLimit, tt.limit)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
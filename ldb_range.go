@@ -0,0 +1,132 @@
+package ctlstore
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ctlstore/pkg/globalstats"
+	"github.com/segmentio/stats"
+)
+
+// RangeOptions describes the bounds of a GetRowsByKeyRange scan. Start is
+// always the lower bound and End always the upper bound, compared
+// lexicographically column by column; a scan can be bounded on any leading
+// subset of the key. This holds regardless of Reverse, which only flips the
+// scan's ORDER BY direction, not which side Start/End bound.
+//
+// After, when set, takes the place of Start as an exclusive cursor so
+// callers can resume a paginated scan without re-supplying Start/Inclusive.
+// Unlike Start, After is direction-aware: resuming a Reverse scan means
+// continuing with keys before the cursor, so After is an upper bound when
+// Reverse is set and a lower bound otherwise.
+type RangeOptions struct {
+	Start          []interface{}
+	End            []interface{}
+	StartInclusive bool
+	EndInclusive   bool
+	Limit          int
+	Reverse        bool
+	After          []interface{}
+}
+
+type rangeCacheKey struct {
+	ldbTableName   string
+	numStartKeys   int
+	numEndKeys     int
+	startInclusive bool
+	endInclusive   bool
+	reverse        bool
+	afterCursor    bool // start bound came from After, so it's direction-aware rather than always the lower bound
+	hasLimit       bool
+}
+
+// buildRangeWhereClause returns the WHERE clause (without the leading WHERE
+// keyword) bounding a range scan described by key, or "" if neither bound is
+// set. Start is always the lower bound and End always the upper bound,
+// regardless of key.reverse - reverse only flips ORDER BY - except when the
+// start bound came from RangeOptions.After (key.afterCursor), which is a
+// direction-aware resume cursor: it's an upper bound when reversed, a lower
+// bound otherwise.
+func buildRangeWhereClause(fieldNames []string, key rangeCacheKey) string {
+	var whereParts []string
+	if key.numStartKeys > 0 {
+		startAscending := true
+		if key.afterCursor {
+			startAscending = !key.reverse
+		}
+		whereParts = append(whereParts, "("+buildRangeBoundClause(fieldNames, key.numStartKeys, key.startInclusive, startAscending)+")")
+	}
+	if key.numEndKeys > 0 {
+		whereParts = append(whereParts, "("+buildRangeBoundClause(fieldNames, key.numEndKeys, key.endInclusive, false)+")")
+	}
+	return strings.Join(whereParts, " AND ")
+}
+
+// buildRangeBoundClause returns the standard lexicographic-comparison
+// expansion for a bound over the leading numKeys primary key columns, e.g.
+// for 3 columns (a, b, c) ascending and exclusive:
+//
+//	(a > ?) OR (a = ? AND b > ?) OR (a = ? AND b = ? AND c > ?)
+//
+// so that SQLite can still satisfy the query with the PK index.
+func buildRangeBoundClause(fieldNames []string, numKeys int, inclusiveLast bool, ascending bool) string {
+	op := ">"
+	if !ascending {
+		op = "<"
+	}
+	clauses := make([]string, 0, numKeys)
+	for i := 0; i < numKeys; i++ {
+		parts := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			parts = append(parts, fieldNames[j]+" = ?")
+		}
+		cmp := op
+		if i == numKeys-1 && inclusiveLast {
+			cmp += "="
+		}
+		parts = append(parts, fieldNames[i]+" "+cmp+" ?")
+		clauses = append(clauses, "("+strings.Join(parts, " AND ")+")")
+	}
+	return strings.Join(clauses, " OR ")
+}
+
+// buildRangeBoundArgs returns the args for buildRangeBoundClause's
+// placeholders, in the same order the clause was built in.
+func buildRangeBoundArgs(keys []interface{}, numKeys int) []interface{} {
+	args := make([]interface{}, 0, numKeys*(numKeys+1)/2)
+	for i := 0; i < numKeys; i++ {
+		for j := 0; j <= i; j++ {
+			args = append(args, keys[j])
+		}
+	}
+	return args
+}
+
+// GetRowsByKeyRange returns a *Rows iterator over rows whose primary key
+// falls within [Start, End] (or the appropriate open/half-open variant, per
+// StartInclusive/EndInclusive). Start and End may each cover any leading
+// prefix of the table's primary key, independently of one another. Results
+// are ordered by primary key, ascending unless Reverse is set.
+//
+// After, when non-empty, is used in place of Start as an exclusive cursor,
+// which is the usual way to resume a paginated scan: pass the key of the
+// last row seen in the previous page.
+func (reader *LDBReader) GetRowsByKeyRange(ctx context.Context, familyName string, tableName string, opts RangeOptions) (*Rows, error) {
+	start := time.Now()
+	defer func() {
+		globalstats.Observe("get_rows_by_key_range", time.Now().Sub(start),
+			stats.T("family", familyName),
+			stats.T("table", tableName))
+	}()
+
+	reader.mu.RLock()
+	defer reader.mu.RUnlock()
+
+	ldbTable, err := resolveLDBTable(familyName, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader.getRowsByKeyRange(ctx, ldbTable, opts)
+}
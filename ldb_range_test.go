@@ -0,0 +1,164 @@
+package ctlstore
+
+import "testing"
+
+func TestBuildRangeBoundClause(t *testing.T) {
+	tests := []struct {
+		name          string
+		fieldNames    []string
+		numKeys       int
+		inclusiveLast bool
+		ascending     bool
+		want          string
+	}{
+		{
+			name:       "single column ascending exclusive",
+			fieldNames: []string{"a"},
+			numKeys:    1,
+			ascending:  true,
+			want:       "(a > ?)",
+		},
+		{
+			name:          "single column ascending inclusive",
+			fieldNames:    []string{"a"},
+			numKeys:       1,
+			inclusiveLast: true,
+			ascending:     true,
+			want:          "(a >= ?)",
+		},
+		{
+			name:       "three columns ascending exclusive",
+			fieldNames: []string{"a", "b", "c"},
+			numKeys:    3,
+			ascending:  true,
+			want:       "(a > ?) OR (a = ? AND b > ?) OR (a = ? AND b = ? AND c > ?)",
+		},
+		{
+			name:          "three columns ascending inclusive last",
+			fieldNames:    []string{"a", "b", "c"},
+			numKeys:       3,
+			inclusiveLast: true,
+			ascending:     true,
+			want:          "(a > ?) OR (a = ? AND b > ?) OR (a = ? AND b = ? AND c >= ?)",
+		},
+		{
+			name:       "descending (reverse scan)",
+			fieldNames: []string{"a", "b"},
+			numKeys:    2,
+			ascending:  false,
+			want:       "(a < ?) OR (a = ? AND b < ?)",
+		},
+		{
+			name:       "bound over a prefix of the full key",
+			fieldNames: []string{"a", "b", "c"},
+			numKeys:    2,
+			ascending:  true,
+			want:       "(a > ?) OR (a = ? AND b > ?)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildRangeBoundClause(tt.fieldNames, tt.numKeys, tt.inclusiveLast, tt.ascending)
+			if got != tt.want {
+				t.Errorf("buildRangeBoundClause(%v, %d, %v, %v) = %q, want %q",
+					tt.fieldNames, tt.numKeys, tt.inclusiveLast, tt.ascending, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRangeWhereClause(t *testing.T) {
+	fieldNames := []string{"a"}
+
+	tests := []struct {
+		name string
+		key  rangeCacheKey
+		want string
+	}{
+		{
+			name: "start is always the lower bound, ascending or reverse",
+			key:  rangeCacheKey{numStartKeys: 1, reverse: false},
+			want: "((a > ?))",
+		},
+		{
+			name: "reverse does not flip Start into an upper bound",
+			key:  rangeCacheKey{numStartKeys: 1, reverse: true},
+			want: "((a > ?))",
+		},
+		{
+			name: "end is always the upper bound, ascending or reverse",
+			key:  rangeCacheKey{numEndKeys: 1, reverse: false},
+			want: "((a < ?))",
+		},
+		{
+			name: "reverse does not flip End into a lower bound",
+			key:  rangeCacheKey{numEndKeys: 1, reverse: true},
+			want: "((a < ?))",
+		},
+		{
+			name: "start and end together, reversed",
+			key:  rangeCacheKey{numStartKeys: 1, numEndKeys: 1, reverse: true},
+			want: "((a > ?)) AND ((a < ?))",
+		},
+		{
+			name: "after cursor is a lower bound scanning ascending",
+			key:  rangeCacheKey{numStartKeys: 1, afterCursor: true, reverse: false},
+			want: "((a > ?))",
+		},
+		{
+			name: "after cursor becomes an upper bound scanning reverse",
+			key:  rangeCacheKey{numStartKeys: 1, afterCursor: true, reverse: true},
+			want: "((a < ?))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildRangeWhereClause(fieldNames, tt.key)
+			if got != tt.want {
+				t.Errorf("buildRangeWhereClause(%v, %+v) = %q, want %q", fieldNames, tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRangeBoundArgs(t *testing.T) {
+	keys := []interface{}{"a", "b", "c"}
+
+	tests := []struct {
+		name    string
+		numKeys int
+		want    []interface{}
+	}{
+		{
+			name:    "one key",
+			numKeys: 1,
+			want:    []interface{}{"a"},
+		},
+		{
+			name:    "two keys",
+			numKeys: 2,
+			want:    []interface{}{"a", "a", "b"},
+		},
+		{
+			name:    "three keys",
+			numKeys: 3,
+			want:    []interface{}{"a", "a", "b", "a", "b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildRangeBoundArgs(keys, tt.numKeys)
+			if len(got) != len(tt.want) {
+				t.Fatalf("buildRangeBoundArgs(..., %d) = %v, want %v", tt.numKeys, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("buildRangeBoundArgs(..., %d)[%d] = %v, want %v", tt.numKeys, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -3,15 +3,11 @@ package ctlstore
 import (
 	"context"
 	"database/sql"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/segmentio/ctlstore/pkg/globalstats"
 	"github.com/segmentio/ctlstore/pkg/ldb"
-	"github.com/segmentio/ctlstore/pkg/scanfunc"
 	"github.com/segmentio/ctlstore/pkg/schema"
-	"github.com/segmentio/ctlstore/pkg/sqlgen"
 	"github.com/segmentio/errors-go"
 	"github.com/segmentio/stats"
 )
@@ -20,11 +16,14 @@ import (
 // thread-safe and it is safe to create as many of these as needed
 // across multiple processes.
 type LDBReader struct {
-	Db                          *sql.DB
-	pkCache                     map[string]schema.PrimaryKey // keyed by ldbTableName()
-	getRowByKeyStmtCache        map[string]*sql.Stmt         // keyed by ldbTableName()
-	getRowsByKeyPrefixStmtCache map[prefixCacheKey]*sql.Stmt
-	mu                          sync.RWMutex
+	Db *sql.DB
+	*queryHandle
+
+	existsStmtCache map[string]*sql.Stmt // keyed by ldbTableName()
+
+	healthy      int32 // atomic; 1 = healthy, 0 = corruption detected
+	recoveryFunc RecoveryFunc
+	onCorruption func(err error)
 }
 
 type prefixCacheKey struct {
@@ -39,8 +38,15 @@ var (
 )
 
 // Constructs an LDBReader from a sql.DB. Really only useful for testing.
-func NewLDBReaderFromDB(db *sql.DB) *LDBReader {
-	return &LDBReader{Db: db}
+func NewLDBReaderFromDB(db *sql.DB, opts ...LDBReaderOption) *LDBReader {
+	reader := &LDBReader{Db: db, queryHandle: &queryHandle{db: db}, healthy: 1}
+	for _, opt := range opts {
+		opt(reader)
+	}
+	if reader.recoveryFunc == nil {
+		reader.recoveryFunc = defaultRecoveryFunc
+	}
+	return reader
 }
 
 // GetLastSequence returns the highest sequence number applied to the DB
@@ -79,50 +85,26 @@ func (reader *LDBReader) GetRowsByKeyPrefix(ctx context.Context, familyName stri
 
 	reader.mu.RLock()
 	defer reader.mu.RUnlock()
-	famName, err := schema.NewFamilyName(familyName)
-	if err != nil {
-		return nil, err
-	}
-	tblName, err := schema.NewTableName(tableName)
-	if err != nil {
-		return nil, err
-	}
-	ldbTable := schema.LDBTableName(famName, tblName)
-	pk, err := reader.getPrimaryKey(ctx, ldbTable)
-	if err != nil {
-		return nil, err
-	}
-	if pk.Zero() {
-		return nil, ErrTableHasNoPrimaryKey
-	}
-	if len(key) > len(pk.Fields) {
-		return nil, errors.New("too many keys supplied for table's primary key")
-	}
-	err = convertKeyBeforeQuery(pk, key)
+
+	ldbTable, err := resolveLDBTable(familyName, tableName)
 	if err != nil {
 		return nil, err
 	}
-	stmt, err := reader.getRowsByKeyPrefixStmt(ctx, pk, ldbTable, len(key))
+
+	rows, err := reader.getRowsByKeyPrefix(ctx, ldbTable, key)
 	if err != nil {
+		if isCorruptionErr(err) {
+			reader.handleCorruption(ctx, err)
+			return nil, ErrLDBCorrupted
+		}
 		return nil, err
 	}
+
 	if len(key) == 0 {
 		globalstats.Incr("full-table-scans", stats.T("family", familyName), stats.T("table", tableName))
 	}
-	rows, err := stmt.QueryContext(ctx, key...)
-	switch {
-	case err == nil:
-		cols, err := schema.DBColumnMetaFromRows(rows)
-		if err != nil {
-			return nil, err
-		}
-		res := &Rows{rows: rows, cols: cols}
-		return res, nil
-	case err == sql.ErrNoRows:
-		return &Rows{}, nil
-	default:
-		return nil, err
-	}
+
+	return rows, nil
 }
 
 // GetRowByKey fetches a row from the supplied table by the key parameter,
@@ -150,94 +132,17 @@ func (reader *LDBReader) GetRowByKey(
 	reader.mu.RLock()
 	defer reader.mu.RUnlock()
 
-	famName, err := schema.NewFamilyName(familyName)
-	if err != nil {
-		return
-	}
-
-	tblName, err := schema.NewTableName(tableName)
+	ldbTable, err := resolveLDBTable(familyName, tableName)
 	if err != nil {
-		return
+		return false, err
 	}
 
-	ldbTable := schema.LDBTableName(famName, tblName)
-
-	// NOTE: A persistent cache is kept on the reader to avoid needing
-	// to query for PKs on every call. Given that most API consumers will
-	// very likely use the global singleton reader, this means that we
-	// must assume that the cache will be shared across the whole process.
-	// The way that a PK would be changed on a table is that it would need
-	// to be dropped and re-created. In the mean time, this cache will
-	// go stale. The way that this is dealt with is to clear the cache if
-	// the statement encounters any execution errors.
-	pk, err := reader.getPrimaryKey(ctx, ldbTable) // assumes RLock held
-	if err != nil {
-		return
+	found, err = reader.getRowByKey(ctx, out, ldbTable, key)
+	if err != nil && isCorruptionErr(err) {
+		reader.handleCorruption(ctx, err)
+		return false, ErrLDBCorrupted
 	}
-
-	if pk.Zero() {
-		err = ErrTableHasNoPrimaryKey
-		return
-	}
-
-	if len(pk.Fields) != len(key) {
-		err = ErrNeedFullKey
-		return
-	}
-
-	// Stmt & PK cache are separate now to give the option to gracefully
-	// move back.
-	stmt, err := reader.getGetRowByKeyStmt(ctx, pk, ldbTable) // assumes RLock held
-	if err != nil {
-		return
-	}
-
-	err = convertKeyBeforeQuery(pk, key)
-	if err != nil {
-		return
-	}
-
-	rows, err := stmt.QueryContext(ctx, key...)
-	if err == sql.ErrNoRows {
-		found = false
-		err = nil
-		rows.Close()
-		return
-	}
-	if err != nil {
-		// See NOTE above about why this cache is getting cleared
-		reader.invalidatePKCache(ldbTable) // assumes RLock is held
-		err = errors.Wrap(err, "query target row error")
-		return
-	}
-	defer rows.Close()
-
-	cols, err := schema.DBColumnMetaFromRows(rows)
-	if err != nil {
-		return
-	}
-
-	scanFunc, err := scanfunc.New(out, cols)
-	if err != nil {
-		return
-	}
-
-	if !rows.Next() {
-		// found is already false by default
-		err = rows.Err()
-		return
-	}
-
-	found = true
-	err = scanFunc(rows)
-
-	if err != nil {
-		err = errors.Wrap(err, "target row scan error")
-	} else {
-		err = rows.Err()
-	}
-
-	return
+	return found, err
 }
 
 func (reader *LDBReader) Close() error {
@@ -250,6 +155,12 @@ func (reader *LDBReader) Close() error {
 	for _, stmt := range reader.getRowsByKeyPrefixStmtCache {
 		stmt.Close()
 	}
+	for _, stmt := range reader.getRowsByRangeStmtCache {
+		stmt.Close()
+	}
+	for _, stmt := range reader.existsStmtCache {
+		stmt.Close()
+	}
 
 	return reader.Db.Close()
 }
@@ -264,10 +175,13 @@ func (reader *LDBReader) Ping(ctx context.Context) bool {
 
 	var seq sql.NullInt64
 	err := row.Scan(&seq)
-	if err != nil || !seq.Valid {
+	if err != nil {
+		if isCorruptionErr(err) {
+			reader.handleCorruption(ctx, err)
+		}
 		return false
 	}
-	return true
+	return seq.Valid
 }
 
 // ensure that a supplied key is converted appropriately with respect
@@ -299,194 +213,3 @@ func (reader *LDBReader) lock() {
 func (reader *LDBReader) unlock() {
 	reader.mu.Unlock()
 }
-
-// WARNING: assumes mutex is read locked
-func (reader *LDBReader) invalidatePKCache(ldbTable string) {
-	if reader.pkCache == nil {
-		// Cache hasn't even been initialized yet, so invalidation would
-		// do nothing anyways.
-		return
-	}
-
-	reader.mu.RUnlock()
-	reader.mu.Lock()
-	delete(reader.pkCache, ldbTable)
-	reader.mu.Unlock()
-	reader.mu.RLock()
-}
-
-// WARNING: assumes mutex is read locked
-func (reader *LDBReader) getPrimaryKey(ctx context.Context, ldbTable string) (schema.PrimaryKey, error) {
-	if reader.pkCache == nil {
-		reader.mu.RUnlock()
-		reader.mu.Lock()
-
-		// double check because there could be a race which would result
-		// in us wiping out the cache
-		if reader.pkCache == nil {
-			reader.pkCache = make(map[string]schema.PrimaryKey)
-		}
-
-		reader.mu.Unlock()
-		reader.mu.RLock()
-	}
-
-	if _, found := reader.pkCache[ldbTable]; !found {
-		const qs = "SELECT name,type FROM pragma_table_info(?) WHERE pk > 0 ORDER BY pk ASC"
-		rows, err := reader.Db.QueryContext(ctx, qs, ldbTable)
-		if err != nil {
-			return schema.PrimaryKeyZero, errors.Wrap(err, "query pragma_table_info error")
-		}
-		defer rows.Close()
-
-		rawFieldNames := []string{}
-		rawFieldTypes := []string{}
-		for rows.Next() {
-			var name string
-			var ftString string
-			err = rows.Scan(&name, &ftString)
-			if err != nil {
-				return schema.PrimaryKeyZero, errors.WithStack(err)
-			}
-			rawFieldNames = append(rawFieldNames, name)
-			rawFieldTypes = append(rawFieldTypes, ftString)
-		}
-		err = rows.Err()
-		if err != nil {
-			return schema.PrimaryKeyZero, errors.WithStack(err)
-		}
-
-		pk, err := schema.NewPKFromRawNamesAndTypes(rawFieldNames, rawFieldTypes)
-		if err != nil {
-			return schema.PrimaryKeyZero, err
-		}
-
-		if pk.Zero() {
-			// There's a potential that this is a missing table, so check
-			// that as well.
-			qs := sqlgen.SqlSprintf("SELECT * FROM $1 LIMIT 1", ldbTable)
-			_, err := reader.Db.ExecContext(ctx, qs)
-			if err != nil {
-				if strings.Index(err.Error(), "no such table:") == 0 {
-					return schema.PrimaryKeyZero, errors.New("Table not found")
-				}
-				return schema.PrimaryKeyZero, err
-			}
-		}
-
-		// Hold the lock for a tiny amount of time. That means there is
-		// a chance for races to cause multiple executions of this block
-		// of code that wastefully do the same thing. That's worth it
-		// to avoid per-key caching complexity and to keep the lock holding
-		// time very short.
-		reader.mu.RUnlock()
-		reader.mu.Lock()
-		reader.pkCache[ldbTable] = pk
-		reader.mu.Unlock()
-		reader.mu.RLock()
-
-		return pk, nil
-	}
-
-	return reader.pkCache[ldbTable], nil
-}
-
-func (reader *LDBReader) getRowsByKeyPrefixStmt(ctx context.Context, pk schema.PrimaryKey, ldbTable string, numKeys int) (*sql.Stmt, error) {
-	// assumes RLock is held
-	if reader.getRowsByKeyPrefixStmtCache == nil {
-		reader.mu.RUnlock()
-		reader.mu.Lock()
-		// double check because there could be a race which would result
-		// in us wiping out the cache
-		if reader.getRowsByKeyPrefixStmtCache == nil {
-			reader.getRowsByKeyPrefixStmtCache = make(map[prefixCacheKey]*sql.Stmt)
-		}
-		reader.mu.Unlock()
-		reader.mu.RLock()
-	}
-	pck := prefixCacheKey{ldbTableName: ldbTable, numKeys: numKeys}
-	stmt, found := reader.getRowsByKeyPrefixStmtCache[pck]
-	if found {
-		return stmt, nil
-	}
-
-	reader.mu.RUnlock()
-	defer reader.mu.RLock()
-	reader.mu.Lock()
-	defer reader.mu.Unlock()
-
-	qsTokens := []string{
-		"SELECT * FROM",
-		ldbTable,
-	}
-	if numKeys > 0 {
-		qsTokens = append(qsTokens, "WHERE")
-		for i := 0; i < numKeys; i++ {
-			pkField := pk.Fields[i]
-			if i > 0 {
-				qsTokens = append(qsTokens, "AND")
-			}
-			qsTokens = append(qsTokens,
-				pkField.Name,
-				"=",
-				"?")
-		}
-	}
-	qs := strings.Join(qsTokens, " ")
-	stmt, err := reader.Db.PrepareContext(ctx, qs)
-	if err == nil {
-		reader.getRowsByKeyPrefixStmtCache[pck] = stmt
-	}
-	return stmt, err
-}
-
-func (reader *LDBReader) getGetRowByKeyStmt(ctx context.Context, pk schema.PrimaryKey, ldbTable string) (*sql.Stmt, error) {
-	// assumes RLock is held
-	if reader.getRowByKeyStmtCache == nil {
-		reader.mu.RUnlock()
-		reader.mu.Lock()
-
-		// double check because there could be a race which would result
-		// in us wiping out the cache
-		if reader.getRowByKeyStmtCache == nil {
-			reader.getRowByKeyStmtCache = make(map[string]*sql.Stmt)
-		}
-
-		reader.mu.Unlock()
-		reader.mu.RLock()
-	}
-
-	stmt, found := reader.getRowByKeyStmtCache[ldbTable]
-	if found {
-		return stmt, nil
-	}
-
-	reader.mu.RUnlock()
-	defer reader.mu.RLock()
-	reader.mu.Lock()
-	defer reader.mu.Unlock()
-
-	qsTokens := []string{
-		"SELECT * FROM",
-		ldbTable,
-		"WHERE",
-	}
-
-	for i, pkField := range pk.Fields {
-		if i > 0 {
-			qsTokens = append(qsTokens, "AND")
-		}
-		qsTokens = append(qsTokens,
-			pkField.Name,
-			"=",
-			"?")
-	}
-
-	qs := strings.Join(qsTokens, " ")
-	stmt, err := reader.Db.PrepareContext(ctx, qs)
-	if err == nil {
-		reader.getRowByKeyStmtCache[ldbTable] = stmt
-	}
-
-	return stmt, err
-}
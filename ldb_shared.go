@@ -0,0 +1,610 @@
+package ctlstore
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/ctlstore/pkg/scanfunc"
+	"github.com/segmentio/ctlstore/pkg/schema"
+	"github.com/segmentio/ctlstore/pkg/sqlgen"
+	"github.com/segmentio/errors-go"
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx. It lets the read-path
+// logic below run unmodified against either the live LDB (LDBReader) or a
+// transaction pinned to a point-in-time view of it (LDBSnapshot).
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// queryHandle holds the caches and statement/query-building logic shared by
+// LDBReader and LDBSnapshot: schema lookups (getPrimaryKey, getColumnSet),
+// prepared-statement caches, and the body of GetRowByKey, GetRowsByKeyPrefix,
+// GetRowsByKeyRange, and QueryRows. LDBReader and LDBSnapshot each embed one,
+// supplying their own queryer (*sql.DB or *sql.Tx) and layering their own
+// behavior on top (corruption recovery and metrics for the reader, tx
+// lifecycle for the snapshot).
+type queryHandle struct {
+	db queryer
+
+	mu                          sync.RWMutex
+	pkCache                     map[string]schema.PrimaryKey    // keyed by ldbTableName()
+	colMetaCache                map[string]map[string]struct{}  // keyed by ldbTableName(), set of column names
+	getRowByKeyStmtCache        map[string]*sql.Stmt            // keyed by ldbTableName()
+	getRowsByKeyPrefixStmtCache map[prefixCacheKey]*sql.Stmt
+	getRowsByRangeStmtCache     map[rangeCacheKey]*sql.Stmt
+}
+
+// resolveLDBTable validates familyName/tableName and returns the LDB table
+// name they refer to.
+func resolveLDBTable(familyName, tableName string) (string, error) {
+	famName, err := schema.NewFamilyName(familyName)
+	if err != nil {
+		return "", err
+	}
+	tblName, err := schema.NewTableName(tableName)
+	if err != nil {
+		return "", err
+	}
+	return schema.LDBTableName(famName, tblName), nil
+}
+
+// WARNING: assumes mutex is read locked
+func (qh *queryHandle) invalidatePKCache(ldbTable string) {
+	if qh.pkCache == nil {
+		// Cache hasn't even been initialized yet, so invalidation would
+		// do nothing anyways.
+		return
+	}
+
+	qh.mu.RUnlock()
+	qh.mu.Lock()
+	delete(qh.pkCache, ldbTable)
+	delete(qh.colMetaCache, ldbTable)
+	qh.mu.Unlock()
+	qh.mu.RLock()
+}
+
+// WARNING: assumes mutex is read locked
+func (qh *queryHandle) getPrimaryKey(ctx context.Context, ldbTable string) (schema.PrimaryKey, error) {
+	if qh.pkCache == nil {
+		qh.mu.RUnlock()
+		qh.mu.Lock()
+
+		// double check because there could be a race which would result
+		// in us wiping out the cache
+		if qh.pkCache == nil {
+			qh.pkCache = make(map[string]schema.PrimaryKey)
+		}
+
+		qh.mu.Unlock()
+		qh.mu.RLock()
+	}
+
+	if _, found := qh.pkCache[ldbTable]; !found {
+		const qs = "SELECT name,type FROM pragma_table_info(?) WHERE pk > 0 ORDER BY pk ASC"
+		rows, err := qh.db.QueryContext(ctx, qs, ldbTable)
+		if err != nil {
+			return schema.PrimaryKeyZero, errors.Wrap(err, "query pragma_table_info error")
+		}
+		defer rows.Close()
+
+		rawFieldNames := []string{}
+		rawFieldTypes := []string{}
+		for rows.Next() {
+			var name string
+			var ftString string
+			err = rows.Scan(&name, &ftString)
+			if err != nil {
+				return schema.PrimaryKeyZero, errors.WithStack(err)
+			}
+			rawFieldNames = append(rawFieldNames, name)
+			rawFieldTypes = append(rawFieldTypes, ftString)
+		}
+		err = rows.Err()
+		if err != nil {
+			return schema.PrimaryKeyZero, errors.WithStack(err)
+		}
+
+		pk, err := schema.NewPKFromRawNamesAndTypes(rawFieldNames, rawFieldTypes)
+		if err != nil {
+			return schema.PrimaryKeyZero, err
+		}
+
+		if pk.Zero() {
+			// There's a potential that this is a missing table, so check
+			// that as well.
+			qs := sqlgen.SqlSprintf("SELECT * FROM $1 LIMIT 1", ldbTable)
+			_, err := qh.db.ExecContext(ctx, qs)
+			if err != nil {
+				if strings.Index(err.Error(), "no such table:") == 0 {
+					return schema.PrimaryKeyZero, errors.New("Table not found")
+				}
+				return schema.PrimaryKeyZero, err
+			}
+		}
+
+		// Hold the lock for a tiny amount of time. That means there is
+		// a chance for races to cause multiple executions of this block
+		// of code that wastefully do the same thing. That's worth it
+		// to avoid per-key caching complexity and to keep the lock holding
+		// time very short.
+		qh.mu.RUnlock()
+		qh.mu.Lock()
+		qh.pkCache[ldbTable] = pk
+		qh.mu.Unlock()
+		qh.mu.RLock()
+
+		return pk, nil
+	}
+
+	return qh.pkCache[ldbTable], nil
+}
+
+// getColumnSet returns the set of column names for ldbTable, querying
+// pragma_table_info the first time and caching the result.
+//
+// WARNING: assumes mutex is read locked
+func (qh *queryHandle) getColumnSet(ctx context.Context, ldbTable string) (map[string]struct{}, error) {
+	if qh.colMetaCache == nil {
+		qh.mu.RUnlock()
+		qh.mu.Lock()
+		if qh.colMetaCache == nil {
+			qh.colMetaCache = make(map[string]map[string]struct{})
+		}
+		qh.mu.Unlock()
+		qh.mu.RLock()
+	}
+
+	if cols, found := qh.colMetaCache[ldbTable]; found {
+		return cols, nil
+	}
+
+	const qs = "SELECT name FROM pragma_table_info(?)"
+	rows, err := qh.db.QueryContext(ctx, qs, ldbTable)
+	if err != nil {
+		return nil, errors.Wrap(err, "query pragma_table_info error")
+	}
+	defer rows.Close()
+
+	cols := make(map[string]struct{})
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		cols[strings.ToLower(name)] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(cols) == 0 {
+		return nil, errors.New("Table not found")
+	}
+
+	qh.mu.RUnlock()
+	qh.mu.Lock()
+	qh.colMetaCache[ldbTable] = cols
+	qh.mu.Unlock()
+	qh.mu.RLock()
+
+	return cols, nil
+}
+
+func (qh *queryHandle) getGetRowByKeyStmt(ctx context.Context, pk schema.PrimaryKey, ldbTable string) (*sql.Stmt, error) {
+	// assumes RLock is held
+	if qh.getRowByKeyStmtCache == nil {
+		qh.mu.RUnlock()
+		qh.mu.Lock()
+
+		// double check because there could be a race which would result
+		// in us wiping out the cache
+		if qh.getRowByKeyStmtCache == nil {
+			qh.getRowByKeyStmtCache = make(map[string]*sql.Stmt)
+		}
+
+		qh.mu.Unlock()
+		qh.mu.RLock()
+	}
+
+	stmt, found := qh.getRowByKeyStmtCache[ldbTable]
+	if found {
+		return stmt, nil
+	}
+
+	qh.mu.RUnlock()
+	defer qh.mu.RLock()
+	qh.mu.Lock()
+	defer qh.mu.Unlock()
+
+	qsTokens := []string{
+		"SELECT * FROM",
+		ldbTable,
+		"WHERE",
+	}
+
+	for i, pkField := range pk.Fields {
+		if i > 0 {
+			qsTokens = append(qsTokens, "AND")
+		}
+		qsTokens = append(qsTokens,
+			pkField.Name,
+			"=",
+			"?")
+	}
+
+	qs := strings.Join(qsTokens, " ")
+	stmt, err := qh.db.PrepareContext(ctx, qs)
+	if err == nil {
+		qh.getRowByKeyStmtCache[ldbTable] = stmt
+	}
+
+	return stmt, err
+}
+
+func (qh *queryHandle) getRowsByKeyPrefixStmt(ctx context.Context, pk schema.PrimaryKey, ldbTable string, numKeys int) (*sql.Stmt, error) {
+	// assumes RLock is held
+	if qh.getRowsByKeyPrefixStmtCache == nil {
+		qh.mu.RUnlock()
+		qh.mu.Lock()
+		// double check because there could be a race which would result
+		// in us wiping out the cache
+		if qh.getRowsByKeyPrefixStmtCache == nil {
+			qh.getRowsByKeyPrefixStmtCache = make(map[prefixCacheKey]*sql.Stmt)
+		}
+		qh.mu.Unlock()
+		qh.mu.RLock()
+	}
+	pck := prefixCacheKey{ldbTableName: ldbTable, numKeys: numKeys}
+	stmt, found := qh.getRowsByKeyPrefixStmtCache[pck]
+	if found {
+		return stmt, nil
+	}
+
+	qh.mu.RUnlock()
+	defer qh.mu.RLock()
+	qh.mu.Lock()
+	defer qh.mu.Unlock()
+
+	qsTokens := []string{
+		"SELECT * FROM",
+		ldbTable,
+	}
+	if numKeys > 0 {
+		qsTokens = append(qsTokens, "WHERE")
+		for i := 0; i < numKeys; i++ {
+			pkField := pk.Fields[i]
+			if i > 0 {
+				qsTokens = append(qsTokens, "AND")
+			}
+			qsTokens = append(qsTokens,
+				pkField.Name,
+				"=",
+				"?")
+		}
+	}
+	qs := strings.Join(qsTokens, " ")
+	stmt, err := qh.db.PrepareContext(ctx, qs)
+	if err == nil {
+		qh.getRowsByKeyPrefixStmtCache[pck] = stmt
+	}
+	return stmt, err
+}
+
+func (qh *queryHandle) getRowsByRangeStmt(ctx context.Context, pk schema.PrimaryKey, ldbTable string, key rangeCacheKey) (*sql.Stmt, error) {
+	// assumes RLock is held
+	if qh.getRowsByRangeStmtCache == nil {
+		qh.mu.RUnlock()
+		qh.mu.Lock()
+		if qh.getRowsByRangeStmtCache == nil {
+			qh.getRowsByRangeStmtCache = make(map[rangeCacheKey]*sql.Stmt)
+		}
+		qh.mu.Unlock()
+		qh.mu.RLock()
+	}
+
+	if stmt, found := qh.getRowsByRangeStmtCache[key]; found {
+		return stmt, nil
+	}
+
+	qh.mu.RUnlock()
+	defer qh.mu.RLock()
+	qh.mu.Lock()
+	defer qh.mu.Unlock()
+
+	fieldNames := make([]string, len(pk.Fields))
+	for i, f := range pk.Fields {
+		fieldNames[i] = f.Name
+	}
+
+	qsTokens := []string{"SELECT * FROM", ldbTable}
+
+	if where := buildRangeWhereClause(fieldNames, key); where != "" {
+		qsTokens = append(qsTokens, "WHERE", where)
+	}
+
+	orderDir := "ASC"
+	if key.reverse {
+		orderDir = "DESC"
+	}
+	orderCols := make([]string, len(fieldNames))
+	for i, name := range fieldNames {
+		orderCols[i] = name + " " + orderDir
+	}
+	qsTokens = append(qsTokens, "ORDER BY", strings.Join(orderCols, ", "))
+
+	if key.hasLimit {
+		qsTokens = append(qsTokens, "LIMIT", "?")
+	}
+
+	qs := strings.Join(qsTokens, " ")
+	stmt, err := qh.db.PrepareContext(ctx, qs)
+	if err == nil {
+		qh.getRowsByRangeStmtCache[key] = stmt
+	}
+	return stmt, err
+}
+
+// getRowByKey is the shared core of (*LDBReader).GetRowByKey and
+// (*LDBSnapshot).GetRowByKey: everything past family/table resolution and
+// (for the reader) corruption detection.
+//
+// WARNING: assumes mutex is read locked
+func (qh *queryHandle) getRowByKey(ctx context.Context, out interface{}, ldbTable string, key []interface{}) (found bool, err error) {
+	// NOTE: A persistent cache is kept to avoid needing to query for PKs
+	// on every call. Given that most API consumers will very likely use
+	// the global singleton reader, this means that we must assume that
+	// the cache will be shared across the whole process. The way that a
+	// PK would be changed on a table is that it would need to be dropped
+	// and re-created. In the mean time, this cache will go stale. The way
+	// that this is dealt with is to clear the cache if the statement
+	// encounters any execution errors.
+	pk, err := qh.getPrimaryKey(ctx, ldbTable)
+	if err != nil {
+		return
+	}
+
+	if pk.Zero() {
+		err = ErrTableHasNoPrimaryKey
+		return
+	}
+
+	if len(pk.Fields) != len(key) {
+		err = ErrNeedFullKey
+		return
+	}
+
+	// Stmt & PK cache are separate now to give the option to gracefully
+	// move back.
+	stmt, err := qh.getGetRowByKeyStmt(ctx, pk, ldbTable)
+	if err != nil {
+		return
+	}
+
+	err = convertKeyBeforeQuery(pk, key)
+	if err != nil {
+		return
+	}
+
+	rows, err := stmt.QueryContext(ctx, key...)
+	if err == sql.ErrNoRows {
+		found = false
+		err = nil
+		rows.Close()
+		return
+	}
+	if err != nil {
+		// See NOTE above about why this cache is getting cleared
+		qh.invalidatePKCache(ldbTable)
+		err = errors.Wrap(err, "query target row error")
+		return
+	}
+	defer rows.Close()
+
+	cols, err := schema.DBColumnMetaFromRows(rows)
+	if err != nil {
+		return
+	}
+
+	scanFunc, err := scanfunc.New(out, cols)
+	if err != nil {
+		return
+	}
+
+	if !rows.Next() {
+		// found is already false by default
+		err = rows.Err()
+		return
+	}
+
+	found = true
+	err = scanFunc(rows)
+
+	if err != nil {
+		err = errors.Wrap(err, "target row scan error")
+	} else {
+		err = rows.Err()
+	}
+
+	return
+}
+
+// getRowsByKeyPrefix is the shared core of (*LDBReader).GetRowsByKeyPrefix
+// and (*LDBSnapshot).GetRowsByKeyPrefix.
+//
+// WARNING: assumes mutex is read locked
+func (qh *queryHandle) getRowsByKeyPrefix(ctx context.Context, ldbTable string, key []interface{}) (*Rows, error) {
+	pk, err := qh.getPrimaryKey(ctx, ldbTable)
+	if err != nil {
+		return nil, err
+	}
+	if pk.Zero() {
+		return nil, ErrTableHasNoPrimaryKey
+	}
+	if len(key) > len(pk.Fields) {
+		return nil, errors.New("too many keys supplied for table's primary key")
+	}
+	if err := convertKeyBeforeQuery(pk, key); err != nil {
+		return nil, err
+	}
+
+	stmt, err := qh.getRowsByKeyPrefixStmt(ctx, pk, ldbTable, len(key))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.QueryContext(ctx, key...)
+	switch {
+	case err == nil:
+		cols, err := schema.DBColumnMetaFromRows(rows)
+		if err != nil {
+			return nil, err
+		}
+		return &Rows{rows: rows, cols: cols}, nil
+	case err == sql.ErrNoRows:
+		return &Rows{}, nil
+	default:
+		qh.invalidatePKCache(ldbTable)
+		return nil, err
+	}
+}
+
+// getRowsByKeyRange is the shared core of (*LDBReader).GetRowsByKeyRange and
+// (*LDBSnapshot).GetRowsByKeyRange.
+//
+// WARNING: assumes mutex is read locked
+func (qh *queryHandle) getRowsByKeyRange(ctx context.Context, ldbTable string, opts RangeOptions) (*Rows, error) {
+	pk, err := qh.getPrimaryKey(ctx, ldbTable)
+	if err != nil {
+		return nil, err
+	}
+	if pk.Zero() {
+		return nil, ErrTableHasNoPrimaryKey
+	}
+
+	startKey := opts.Start
+	startInclusive := opts.StartInclusive
+	afterCursor := false
+	if len(opts.After) > 0 {
+		startKey = opts.After
+		startInclusive = false
+		afterCursor = true
+	}
+
+	if len(startKey) > len(pk.Fields) || len(opts.End) > len(pk.Fields) {
+		return nil, errors.New("too many keys supplied for table's primary key")
+	}
+	if err := convertKeyBeforeQuery(pk, startKey); err != nil {
+		return nil, err
+	}
+	if err := convertKeyBeforeQuery(pk, opts.End); err != nil {
+		return nil, err
+	}
+
+	cacheKey := rangeCacheKey{
+		ldbTableName:   ldbTable,
+		numStartKeys:   len(startKey),
+		numEndKeys:     len(opts.End),
+		startInclusive: startInclusive,
+		endInclusive:   opts.EndInclusive,
+		reverse:        opts.Reverse,
+		afterCursor:    afterCursor,
+		hasLimit:       opts.Limit > 0,
+	}
+	stmt, err := qh.getRowsByRangeStmt(ctx, pk, ldbTable, cacheKey)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]interface{}, 0, len(startKey)+len(opts.End)+1)
+	args = append(args, buildRangeBoundArgs(startKey, len(startKey))...)
+	args = append(args, buildRangeBoundArgs(opts.End, len(opts.End))...)
+	if opts.Limit > 0 {
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	switch {
+	case err == nil:
+		cols, err := schema.DBColumnMetaFromRows(rows)
+		if err != nil {
+			return nil, err
+		}
+		return &Rows{rows: rows, cols: cols}, nil
+	case err == sql.ErrNoRows:
+		return &Rows{}, nil
+	default:
+		qh.invalidatePKCache(ldbTable)
+		return nil, errors.Wrap(err, "query rows by range error")
+	}
+}
+
+// queryRows is the shared core of (*LDBReader).QueryRows and
+// (*LDBSnapshot).QueryRows.
+//
+// WARNING: assumes mutex is read locked
+func (qh *queryHandle) queryRows(ctx context.Context, ldbTable string, query string, args []interface{}) (*Rows, error) {
+	parsed, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(parsed.table, ldbTable) {
+		return nil, errors.Wrap(ErrUnsupportedQuery, "query FROM target does not match the supplied family/table")
+	}
+
+	// Reuses the same pkCache lookup as the rest of the reader, which also
+	// has the side effect of confirming the table exists.
+	if _, err := qh.getPrimaryKey(ctx, ldbTable); err != nil {
+		return nil, err
+	}
+
+	cols, err := qh.getColumnSet(ctx, ldbTable)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateIdentifiers(parsed.columns, cols); err != nil {
+		return nil, err
+	}
+	if parsed.orderBy != "" {
+		orderCols := strings.Split(parsed.orderBy, ",")
+		for i := range orderCols {
+			orderCols[i] = strings.TrimSpace(orderCols[i])
+		}
+		if err := validateIdentifiers(orderCols, cols); err != nil {
+			return nil, err
+		}
+	}
+
+	qsTokens := []string{"SELECT", strings.Join(parsed.columns, ", "), "FROM", ldbTable}
+	if parsed.where != "" {
+		qsTokens = append(qsTokens, "WHERE", parsed.where)
+	}
+	if parsed.orderBy != "" {
+		qsTokens = append(qsTokens, "ORDER BY", parsed.orderBy)
+	}
+	if parsed.hasLimit {
+		qsTokens = append(qsTokens, "LIMIT", strconv.Itoa(parsed.limit))
+	}
+	qs := strings.Join(qsTokens, " ")
+
+	rows, err := qh.db.QueryContext(ctx, qs, args...)
+	switch {
+	case err == nil:
+		resCols, err := schema.DBColumnMetaFromRows(rows)
+		if err != nil {
+			return nil, err
+		}
+		return &Rows{rows: rows, cols: resCols}, nil
+	case err == sql.ErrNoRows:
+		return &Rows{}, nil
+	default:
+		qh.invalidatePKCache(ldbTable)
+		return nil, errors.Wrap(err, "query rows error")
+	}
+}
@@ -0,0 +1,158 @@
+package ctlstore
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/segmentio/ctlstore/pkg/ldb"
+	"github.com/segmentio/ctlstore/pkg/schema"
+	"github.com/segmentio/errors-go"
+)
+
+// ErrSequenceNotAvailable is returned by SnapshotAt when the LDB has
+// already advanced past the requested DMLSequence by more than the
+// caller's staleness budget.
+var ErrSequenceNotAvailable = errors.New("requested sequence is not available in a snapshot-consistent read")
+
+// LDBSnapshot is a read-only, transactionally consistent view of the LDB
+// pinned to the DMLSequence observed when the snapshot was taken. Reads
+// through a snapshot never see updates the reflector applies after the
+// snapshot was opened, which makes it possible to read several tables and
+// get a consistent picture across all of them.
+//
+// A snapshot starts from a copy of its parent reader's PK and column-set
+// caches (copied at creation time, so neither side mutates the other's) but
+// keeps its own prepared statement cache tied to its transaction. Close
+// must be called to release the underlying transaction.
+type LDBSnapshot struct {
+	tx  *sql.Tx
+	seq schema.DMLSequence
+	*queryHandle
+}
+
+// Snapshot opens a read transaction against the LDB and returns an
+// LDBSnapshot pinned to the DMLSequence observed at the time the
+// transaction began. All reads through the snapshot observe that same
+// point-in-time view, even as the reflector continues to apply updates
+// visible through the parent reader.
+func (reader *LDBReader) Snapshot(ctx context.Context) (*LDBSnapshot, error) {
+	reader.mu.RLock()
+	defer reader.mu.RUnlock()
+
+	tx, err := reader.Db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "begin snapshot transaction")
+	}
+
+	qs := "SELECT seq FROM " + ldb.LDBSeqTableName + " WHERE id = ?"
+	var seq schema.DMLSequence
+	if err := tx.QueryRowContext(ctx, qs, ldb.LDBSeqTableID).Scan(&seq); err != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(err, "fetch snapshot sequence")
+	}
+
+	pkCache := make(map[string]schema.PrimaryKey, len(reader.pkCache))
+	for ldbTable, pk := range reader.pkCache {
+		pkCache[ldbTable] = pk
+	}
+	colMetaCache := make(map[string]map[string]struct{}, len(reader.colMetaCache))
+	for ldbTable, cols := range reader.colMetaCache {
+		colMetaCache[ldbTable] = cols
+	}
+
+	return &LDBSnapshot{
+		tx:          tx,
+		seq:         seq,
+		queryHandle: &queryHandle{db: tx, pkCache: pkCache, colMetaCache: colMetaCache},
+	}, nil
+}
+
+// SnapshotAt returns a snapshot pinned to seq, or ErrSequenceNotAvailable if
+// the LDB has already advanced past seq by more than maxStaleness, or if
+// the reflector hasn't reached seq yet.
+func (reader *LDBReader) SnapshotAt(ctx context.Context, seq schema.DMLSequence, maxStaleness schema.DMLSequence) (*LDBSnapshot, error) {
+	snap, err := reader.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if snap.seq < seq || snap.seq-seq > maxStaleness {
+		snap.Close()
+		return nil, ErrSequenceNotAvailable
+	}
+	return snap, nil
+}
+
+// Sequence returns the DMLSequence this snapshot is pinned to.
+func (snap *LDBSnapshot) Sequence() schema.DMLSequence {
+	return snap.seq
+}
+
+// Close rolls back the snapshot's underlying transaction and releases its
+// prepared statements. It does not affect the parent reader.
+func (snap *LDBSnapshot) Close() error {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+
+	for _, stmt := range snap.getRowByKeyStmtCache {
+		stmt.Close()
+	}
+	for _, stmt := range snap.getRowsByKeyPrefixStmtCache {
+		stmt.Close()
+	}
+	for _, stmt := range snap.getRowsByRangeStmtCache {
+		stmt.Close()
+	}
+
+	return snap.tx.Rollback()
+}
+
+// GetRowByKey is the snapshot-pinned equivalent of (*LDBReader).GetRowByKey:
+// it reads through the snapshot's transaction instead of the live DB.
+func (snap *LDBSnapshot) GetRowByKey(ctx context.Context, out interface{}, familyName string, tableName string, key ...interface{}) (bool, error) {
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+
+	ldbTable, err := resolveLDBTable(familyName, tableName)
+	if err != nil {
+		return false, err
+	}
+	return snap.getRowByKey(ctx, out, ldbTable, key)
+}
+
+// GetRowsByKeyPrefix is the snapshot-pinned equivalent of
+// (*LDBReader).GetRowsByKeyPrefix.
+func (snap *LDBSnapshot) GetRowsByKeyPrefix(ctx context.Context, familyName string, tableName string, key ...interface{}) (*Rows, error) {
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+
+	ldbTable, err := resolveLDBTable(familyName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return snap.getRowsByKeyPrefix(ctx, ldbTable, key)
+}
+
+// GetRowsByKeyRange is the snapshot-pinned equivalent of
+// (*LDBReader).GetRowsByKeyRange.
+func (snap *LDBSnapshot) GetRowsByKeyRange(ctx context.Context, familyName string, tableName string, opts RangeOptions) (*Rows, error) {
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+
+	ldbTable, err := resolveLDBTable(familyName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return snap.getRowsByKeyRange(ctx, ldbTable, opts)
+}
+
+// QueryRows is the snapshot-pinned equivalent of (*LDBReader).QueryRows.
+func (snap *LDBSnapshot) QueryRows(ctx context.Context, familyName string, tableName string, query string, args ...interface{}) (*Rows, error) {
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+
+	ldbTable, err := resolveLDBTable(familyName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return snap.queryRows(ctx, ldbTable, query, args)
+}